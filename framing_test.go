@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNewlineReaderSplitsOnNewline(t *testing.T) {
+	rr, err := newRecordReader(strings.NewReader("one\ntwo\nthree"), "newline", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		record, err := rr.ReadRecord()
+		if len(record) > 0 {
+			got = append(got, string(record))
+		}
+		if err != nil {
+			break
+		}
+	}
+	want := []string{"one\n", "two\n", "three"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("record %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func lengthPrefixed(s string) []byte {
+	var buf bytes.Buffer
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(s)))
+	buf.Write(lenBuf[:])
+	buf.WriteString(s)
+	return buf.Bytes()
+}
+
+func TestLengthPrefixedReaderReadsRecord(t *testing.T) {
+	rr, err := newRecordReader(bytes.NewReader(lengthPrefixed("hello")), "length-prefixed", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := rr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(record) != "hello" {
+		t.Fatalf("got %q, want %q", record, "hello")
+	}
+}
+
+func TestLengthPrefixedReaderRejectsOversizedLength(t *testing.T) {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], 0xFFFFFFFF)
+	rr, err := newRecordReader(bytes.NewReader(lenBuf[:]), "length-prefixed", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rr.ReadRecord()
+	if err == nil {
+		t.Fatal("expected an error for a record claiming to exceed maxRecordBytes, got nil")
+	}
+	if err == io.EOF {
+		t.Fatalf("expected a size-limit error, got io.EOF")
+	}
+}
+
+func TestJSONStreamReaderReadsConcatenatedObjects(t *testing.T) {
+	rr, err := newRecordReader(strings.NewReader(`{"a":1}{"b":2}`), "json-stream", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := rr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != `{"a":1}`+"\n" {
+		t.Fatalf("got %q", first)
+	}
+	second, err := rr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(second) != `{"b":2}`+"\n" {
+		t.Fatalf("got %q", second)
+	}
+}
+
+func TestShardKeyExtractsField(t *testing.T) {
+	if got := shardKey([]byte(`{"tenant_id":"abc","x":1}`), "tenant_id"); got != "abc" {
+		t.Fatalf("got %q, want %q", got, "abc")
+	}
+}
+
+func TestShardKeyMissingFieldOrInvalidJSON(t *testing.T) {
+	if got := shardKey([]byte(`{"x":1}`), "tenant_id"); got != "" {
+		t.Fatalf("got %q, want empty", got)
+	}
+	if got := shardKey([]byte("not json"), "tenant_id"); got != "" {
+		t.Fatalf("got %q, want empty", got)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+// virtualNodesPerWorker is how many points each worker gets on the ring.
+const virtualNodesPerWorker = 100
+
+type ringPoint struct {
+	hash   uint32
+	worker int
+}
+
+// HashRing consistent-hashes shard keys onto worker indices.
+type HashRing struct {
+	points []ringPoint
+}
+
+// NewHashRing builds a ring over numWorkers workers, indexed 0..numWorkers-1.
+func NewHashRing(numWorkers int) *HashRing {
+	points := make([]ringPoint, 0, numWorkers*virtualNodesPerWorker)
+	for w := 0; w < numWorkers; w++ {
+		for v := 0; v < virtualNodesPerWorker; v++ {
+			var buf [8]byte
+			binary.BigEndian.PutUint32(buf[:4], uint32(w))
+			binary.BigEndian.PutUint32(buf[4:], uint32(v))
+			h := fnv.New32a()
+			h.Write(buf[:])
+			points = append(points, ringPoint{hash: h.Sum32(), worker: w})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	return &HashRing{points: points}
+}
+
+// WorkerFor returns the worker index that owns key.
+func (r *HashRing) WorkerFor(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	hash := h.Sum32()
+	idx := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if idx == len(r.points) {
+		idx = 0
+	}
+	return r.points[idx].worker
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRingWorkerForIsStable(t *testing.T) {
+	ring := NewHashRing(8)
+	for _, key := range []string{"tenant-a", "tenant-b", "", "12345"} {
+		first := ring.WorkerFor(key)
+		for i := 0; i < 100; i++ {
+			if got := ring.WorkerFor(key); got != first {
+				t.Fatalf("WorkerFor(%q) = %d on call %d, want %d (stable)", key, got, i, first)
+			}
+		}
+	}
+}
+
+func TestHashRingDistributesAcrossWorkers(t *testing.T) {
+	const numWorkers = 8
+	ring := NewHashRing(numWorkers)
+	seen := make(map[int]int)
+	for i := 0; i < 10000; i++ {
+		w := ring.WorkerFor(fmt.Sprintf("key-%d", i))
+		seen[w]++
+	}
+	if len(seen) != numWorkers {
+		t.Fatalf("only %d/%d workers received any keys: %v", len(seen), numWorkers, seen)
+	}
+}
+
+func TestHashRingWorkerForInRange(t *testing.T) {
+	ring := NewHashRing(4)
+	for i := 0; i < 1000; i++ {
+		w := ring.WorkerFor(fmt.Sprintf("k%d", i))
+		if w < 0 || w >= 4 {
+			t.Fatalf("WorkerFor returned out-of-range worker %d", w)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Backend is one concrete, dialable address behind a TargetGroup.
+type Backend struct {
+	addr   string
+	weight int
+
+	mu     sync.RWMutex
+	up     bool
+	ewmaMs float64
+
+	active int64 // atomic
+	cancel context.CancelFunc
+}
+
+func newBackend(addr string, weight int) *Backend {
+	return &Backend{addr: addr, weight: weight, up: true}
+}
+
+func (b *Backend) IsUp() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.up
+}
+
+func (b *Backend) setUp(up bool) {
+	b.mu.Lock()
+	changed := b.up != up
+	b.up = up
+	b.mu.Unlock()
+	if !changed {
+		return
+	}
+	if up {
+		log.Info().Msgf("Backend %s: healthy", b.addr)
+	} else {
+		log.Warn().Msgf("Backend %s: unhealthy", b.addr)
+	}
+}
+
+func (b *Backend) incActive()    { atomic.AddInt64(&b.active, 1) }
+func (b *Backend) decActive()    { atomic.AddInt64(&b.active, -1) }
+func (b *Backend) Active() int64 { return atomic.LoadInt64(&b.active) }
+
+// observe folds a new dial/health-check latency sample into the backend's
+// EWMA, used by the ewma balancer policy.
+func (b *Backend) observe(latency time.Duration) {
+	const alpha = 0.2
+	ms := float64(latency.Milliseconds())
+	b.mu.Lock()
+	if b.ewmaMs == 0 {
+		b.ewmaMs = ms
+	} else {
+		b.ewmaMs = alpha*ms + (1-alpha)*b.ewmaMs
+	}
+	b.mu.Unlock()
+}
+
+func (b *Backend) ewma() float64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.ewmaMs
+}
+
+// Balancer picks which backend a worker should try next out of a
+// TargetGroup's current, health-checked backend set.
+type Balancer interface {
+	Pick(backends []*Backend, avoid *Backend) (*Backend, error)
+}
+
+func newBalancer(name string) (Balancer, error) {
+	switch name {
+	case "", "round-robin":
+		return &roundRobinBalancer{}, nil
+	case "least-connections":
+		return &leastConnectionsBalancer{}, nil
+	case "weighted":
+		return &weightedBalancer{}, nil
+	case "ewma":
+		return &ewmaBalancer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown -balancer value %q", name)
+	}
+}
+
+// upBackends returns the healthy backends other than avoid. If health
+// checks have failed every backend, it falls back to "everything but avoid"
+// so the LB keeps trying rather than refusing to connect at all. avoid is
+// never allowed to exclude the only backend a target has -- otherwise a
+// single-backend target that just failed a dial would have no candidate
+// left at all, and never get retried again even once it recovers.
+func upBackends(backends []*Backend, avoid *Backend) []*Backend {
+	if len(backends) == 1 {
+		return backends
+	}
+	up := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b == avoid || !b.IsUp() {
+			continue
+		}
+		up = append(up, b)
+	}
+	if len(up) > 0 {
+		return up
+	}
+	for _, b := range backends {
+		if b != avoid {
+			up = append(up, b)
+		}
+	}
+	return up
+}
+
+type roundRobinBalancer struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (r *roundRobinBalancer) Pick(backends []*Backend, avoid *Backend) (*Backend, error) {
+	up := upBackends(backends, avoid)
+	if len(up) == 0 {
+		return nil, fmt.Errorf("no backends available")
+	}
+	r.mu.Lock()
+	idx := r.next % len(up)
+	r.next++
+	r.mu.Unlock()
+	return up[idx], nil
+}
+
+type leastConnectionsBalancer struct{}
+
+func (leastConnectionsBalancer) Pick(backends []*Backend, avoid *Backend) (*Backend, error) {
+	up := upBackends(backends, avoid)
+	if len(up) == 0 {
+		return nil, fmt.Errorf("no backends available")
+	}
+	best := up[0]
+	for _, b := range up[1:] {
+		if b.Active() < best.Active() {
+			best = b
+		}
+	}
+	return best, nil
+}
+
+type weightedBalancer struct {
+	mu sync.Mutex
+}
+
+func (w *weightedBalancer) Pick(backends []*Backend, avoid *Backend) (*Backend, error) {
+	up := upBackends(backends, avoid)
+	if len(up) == 0 {
+		return nil, fmt.Errorf("no backends available")
+	}
+	total := 0
+	for _, b := range up {
+		total += weightOf(b)
+	}
+	w.mu.Lock()
+	r := rand.Intn(total)
+	w.mu.Unlock()
+	for _, b := range up {
+		wt := weightOf(b)
+		if r < wt {
+			return b, nil
+		}
+		r -= wt
+	}
+	return up[len(up)-1], nil
+}
+
+func weightOf(b *Backend) int {
+	if b.weight > 0 {
+		return b.weight
+	}
+	return 1
+}
+
+type ewmaBalancer struct{}
+
+func (ewmaBalancer) Pick(backends []*Backend, avoid *Backend) (*Backend, error) {
+	up := upBackends(backends, avoid)
+	if len(up) == 0 {
+		return nil, fmt.Errorf("no backends available")
+	}
+	best := up[0]
+	for _, b := range up[1:] {
+		// Backends with no samples yet are treated as the most attractive,
+		// so newly-discovered or just-recovered backends get exercised.
+		if best.ewma() != 0 && (b.ewma() == 0 || b.ewma() < best.ewma()) {
+			best = b
+		}
+	}
+	return best, nil
+}
+
+// TargetGroup is one entry from -target, plus its currently-resolved backends.
+type TargetGroup struct {
+	Name     string // as configured, e.g. "logs.example.com:9000"
+	host     string
+	port     string
+	weight   int
+	balancer Balancer
+	dialer   Dialer // how to dial this group's backends; set by the caller after construction
+
+	mu       sync.RWMutex
+	backends map[string]*Backend // keyed by resolved addr
+}
+
+// parseTargetSpec splits an optional "@weight" suffix off a configured
+// target, e.g. "logs.example.com:9000@3" for the weighted balancer.
+func parseTargetSpec(spec string) (addr string, weight int, err error) {
+	weight = 1
+	if i := strings.LastIndexByte(spec, '@'); i != -1 {
+		w, werr := strconv.Atoi(spec[i+1:])
+		if werr != nil || w <= 0 {
+			return "", 0, fmt.Errorf("invalid weight in target %q", spec)
+		}
+		return spec[:i], w, nil
+	}
+	return spec, weight, nil
+}
+
+func newTargetGroup(spec, balancerName string) (*TargetGroup, error) {
+	addr, weight, err := parseTargetSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", spec, err)
+	}
+	balancer, err := newBalancer(balancerName)
+	if err != nil {
+		return nil, err
+	}
+	return &TargetGroup{
+		Name:     addr,
+		host:     host,
+		port:     port,
+		weight:   weight,
+		balancer: balancer,
+		backends: make(map[string]*Backend),
+	}, nil
+}
+
+func (g *TargetGroup) Backends() []*Backend {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	out := make([]*Backend, 0, len(g.backends))
+	for _, b := range g.backends {
+		out = append(out, b)
+	}
+	return out
+}
+
+func (g *TargetGroup) Pick(avoid *Backend) (*Backend, error) {
+	return g.balancer.Pick(g.Backends(), avoid)
+}
+
+// resolve re-resolves the group's host and starts/stops health checkers so
+// the backend set tracks DNS (e.g. a headless Kubernetes service) without a
+// restart.
+func (g *TargetGroup) resolve(ctx context.Context, healthInterval time.Duration, healthProbe string) {
+	ips, err := net.LookupHost(g.host)
+	if err != nil || len(ips) == 0 {
+		log.Warn().Msgf("Target %s: DNS lookup failed: %v", g.Name, err)
+		return
+	}
+
+	wanted := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		wanted[net.JoinHostPort(ip, g.port)] = true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for addr := range wanted {
+		if _, ok := g.backends[addr]; ok {
+			continue
+		}
+		b := newBackend(addr, g.weight)
+		bctx, cancel := context.WithCancel(ctx)
+		b.cancel = cancel
+		g.backends[addr] = b
+		log.Info().Msgf("Target %s: discovered backend %s", g.Name, addr)
+		go healthCheck(bctx, b, g.dialer, healthInterval, healthProbe)
+	}
+	for addr, b := range g.backends {
+		if wanted[addr] {
+			continue
+		}
+		log.Info().Msgf("Target %s: backend %s no longer resolves, removing", g.Name, addr)
+		// Mark it down first: a worker still connected to it only notices
+		// via IsUp() on its next ConnectIfNeeded check, and would otherwise
+		// keep sending it traffic until that connection happens to break.
+		b.setUp(false)
+		b.cancel()
+		delete(g.backends, addr)
+	}
+}
+
+// watchDNS resolves the group once up front and, unless host is a bare IP,
+// keeps re-resolving on dnsInterval until ctx is done.
+func (g *TargetGroup) watchDNS(ctx context.Context, dnsInterval, healthInterval time.Duration, healthProbe string) {
+	g.resolve(ctx, healthInterval, healthProbe)
+	if net.ParseIP(g.host) != nil {
+		return
+	}
+	ticker := time.NewTicker(dnsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.resolve(ctx, healthInterval, healthProbe)
+		}
+	}
+}
+
+// healthCheck actively probes one backend every interval: a bare connect by
+// default, or a connect followed by writing probePayload, marking the
+// backend down on any failure and feeding the ewma balancer's latency signal.
+func healthCheck(ctx context.Context, b *Backend, dialer Dialer, interval time.Duration, probePayload string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		dialCtx, cancel := context.WithTimeout(ctx, interval/2)
+		start := time.Now()
+		conn, err := dialer.DialContext(dialCtx, "tcp", b.addr)
+		if err == nil && probePayload != "" {
+			conn.SetDeadline(time.Now().Add(interval / 2))
+			_, err = conn.Write([]byte(probePayload))
+		}
+		cancel()
+		if conn != nil {
+			conn.Close()
+		}
+		if err != nil {
+			b.setUp(false)
+		} else {
+			b.setUp(true)
+			b.observe(time.Since(start))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestUpBackendsExcludesAvoid(t *testing.T) {
+	a := newBackend("a:1", 1)
+	b := newBackend("b:1", 1)
+	got := upBackends([]*Backend{a, b}, a)
+	if len(got) != 1 || got[0] != b {
+		t.Fatalf("upBackends(%v) = %v, want [b]", []*Backend{a, b}, got)
+	}
+}
+
+func TestUpBackendsFallsBackWhenAllDown(t *testing.T) {
+	a := newBackend("a:1", 1)
+	b := newBackend("b:1", 1)
+	a.setUp(false)
+	b.setUp(false)
+	got := upBackends([]*Backend{a, b}, a)
+	if len(got) != 1 || got[0] != b {
+		t.Fatalf("upBackends(%v) = %v, want [b]", []*Backend{a, b}, got)
+	}
+}
+
+// TestUpBackendsNeverExcludesTheOnlyBackend guards against a regression
+// where a single-backend target, once avoided after one failed dial, would
+// never be offered to the worker again -- not even after a health check
+// marked it back up, since avoid filters on identity rather than health.
+func TestUpBackendsNeverExcludesTheOnlyBackend(t *testing.T) {
+	a := newBackend("a:1", 1)
+	got := upBackends([]*Backend{a}, a)
+	if len(got) != 1 || got[0] != a {
+		t.Fatalf("upBackends([a], a) = %v, want [a]", got)
+	}
+
+	a.setUp(false)
+	got = upBackends([]*Backend{a}, a)
+	if len(got) != 1 || got[0] != a {
+		t.Fatalf("upBackends([a], a) with a down = %v, want [a]", got)
+	}
+}
+
+func TestRoundRobinBalancerPicksSingleBackendAfterAvoiding(t *testing.T) {
+	a := newBackend("a:1", 1)
+	bal := &roundRobinBalancer{}
+	if _, err := bal.Pick([]*Backend{a}, nil); err != nil {
+		t.Fatalf("Pick before any failure: %v", err)
+	}
+	// Simulate a failed dial: the caller marks the backend down and avoids
+	// it on the next attempt, same as Worker.ConnectWithRetries does.
+	a.setUp(false)
+	got, err := bal.Pick([]*Backend{a}, a)
+	if err != nil {
+		t.Fatalf("Pick after avoiding the only backend: %v", err)
+	}
+	if got != a {
+		t.Fatalf("Pick returned %v, want the only backend a", got)
+	}
+}
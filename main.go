@@ -3,10 +3,11 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
-	"math/rand"
+	"io"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
@@ -31,46 +32,88 @@ var bufPool = sync.Pool{
 	},
 }
 
-func receive(conn net.Conn, out chan *bytes.Buffer) {
+// receive reads records from conn (per the configured framing) and routes
+// each one to a worker's output channel. With shardField set, routing goes
+// through the hash ring so records sharing that field's value always land on
+// the same worker/upstream connection; otherwise records are spread round-robin.
+func receive(conn net.Conn, outs []chan *bytes.Buffer, framing, shardField string, ring *HashRing, maxRecordBytes int) {
 	log.Debug().Msgf("New connection from %s", conn.RemoteAddr())
 	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Msgf("Connection from %s: recovered from panic: %v", conn.RemoteAddr(), r)
+		}
+	}()
+
+	rr, err := newRecordReader(conn, framing, maxRecordBytes)
+	if err != nil {
+		log.Error().Msgf("Connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
 
-	buf := make([]byte, bufferSize)
-	var stringbuf *bytes.Buffer
-	stringbuf = bufPool.Get().(*bytes.Buffer)
+	var rrCounter int
 	for {
-		n, err := conn.Read(buf)
+		record, err := rr.ReadRecord()
+		if len(record) > 0 {
+			recordsInTotal.Inc()
+			bytesInTotal.Add(float64(len(record)))
+
+			buf := bufPool.Get().(*bytes.Buffer)
+			buf.Write(record)
+
+			var idx int
+			if shardField != "" {
+				idx = ring.WorkerFor(shardKey(record, shardField))
+			} else {
+				idx = rrCounter % len(outs)
+				rrCounter++
+			}
+			outs[idx] <- buf
+		}
 		if err != nil {
-			if errors.Is(err, net.ErrClosed) {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				log.Debug().Msgf("Closed inbound connection from %s", conn.RemoteAddr())
 			} else {
 				log.Debug().Msgf("Error reading from %s: %v", conn.RemoteAddr(), err)
 			}
 			break
 		}
+	}
+}
 
-		lastNewlineIndex := bytes.LastIndexByte(buf[:n], byte('\n'))
-		if lastNewlineIndex != -1 {
-			//Newline, truncate and send
-			stringbuf.Write(buf[:lastNewlineIndex+1])
-			out <- stringbuf
-			stringbuf = bufPool.Get().(*bytes.Buffer)
-			stringbuf.Write(buf[lastNewlineIndex+1 : n])
-		} else {
-			//No Newline, append to buffer
-			stringbuf.Write(buf[:n])
-		}
+// Dialer is the minimal interface Worker needs in order to open upstream
+// connections. *net.Dialer and *tls.Dialer both satisfy it, so whether a
+// Worker speaks plaintext or TLS upstream is just a matter of which Dialer
+// it is constructed with.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// newUpstreamDialer builds the Dialer for one target group's backends.
+// tlsCfg is nil without -upstream-tls. Without an explicit -upstream-sni,
+// ServerName defaults to host rather than being left for tls.Dialer to infer
+// from the dialed addr, which by the time a backend is DNS-resolved is an
+// IP, not the hostname the upstream cert was issued for.
+func newUpstreamDialer(tlsCfg *tls.Config, host string) Dialer {
+	if tlsCfg == nil {
+		return &net.Dialer{}
 	}
-	if stringbuf.Len() > 0 {
-		out <- stringbuf
+	cfg := tlsCfg
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = host
 	}
+	return &tls.Dialer{Config: cfg}
 }
 
 type Worker struct {
 	id            int
-	targets       []string //The list of all available targets
-	target        string   //The currently used target
-	targetIdx     int      //The index of the default target this worker should be using
+	group         *TargetGroup //The logical target (-target entry) this worker is pinned to
+	target        string       //The group name, kept for metrics/spool/readiness labels
+	backend       *Backend     //The concrete backend currently connected to, chosen by the group's Balancer
+	dialer        Dialer       //How to open connections to a backend (plaintext or TLS)
+	ready         *readiness
+	spools        map[string]*Spool //Per-target write-ahead spool, nil entries/map if -spool-dir is unset
 	conn          net.Conn
 	lastReconnect time.Time
 }
@@ -79,38 +122,54 @@ func (w Worker) String() string {
 	return fmt.Sprintf("worker-%02d", w.id)
 }
 
-func (w Worker) isConnectedToPrimary() bool {
-	return w.target == w.targets[w.targetIdx]
-}
-
-// ConnectWithRetries tries to connect to a target with exponential backoff
+// ConnectWithRetries asks the group's Balancer for a backend and dials it,
+// retrying with exponential backoff (and avoiding the last failed backend)
+// until one succeeds or ctx is done.
 func (w *Worker) ConnectWithRetries(ctx context.Context) error {
-	rand.Seed(time.Now().UnixNano())
 	delay := 2 * time.Second
-	targetIdx := w.targetIdx //Leave the desired one alone
+	var avoid *Backend
 	for {
-		w.target = w.targets[targetIdx]
-		//log.Printf("Worker %d: Opening connection to %v", w.id, w.target)
-		conn, err := net.DialTimeout("tcp", w.target, 5*time.Second)
+		backend, pickErr := w.group.Pick(avoid)
+		if pickErr != nil {
+			log.Warn().Msgf("Worker %d: %s: %v", w.id, w.target, pickErr)
+			select {
+			case <-ctx.Done():
+				return pickErr
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		start := time.Now()
+		conn, err := w.dialer.DialContext(dialCtx, "tcp", backend.addr)
+		cancel()
 		if err == nil {
 			w.Close()
-			log.Info().Msgf("Worker %d: connected to %s", w.id, w.target)
+			log.Info().Msgf("Worker %d: connected to %s (%s)", w.id, backend.addr, w.target)
 			w.conn = conn
+			w.backend = backend
 			w.lastReconnect = time.Now()
+			backend.incActive()
+			backend.observe(time.Since(start))
+			connectsTotal.WithLabelValues(w.target).Inc()
+			targetConnected.WithLabelValues(w.target, w.String()).Set(1)
+			w.ready.setConnected(w.target, true)
 			return nil
 		}
-		log.Warn().Msgf("Worker %d: Unable connect to %s: %v", w.id, w.target, err)
-		//The context is done
-		if ctx.Err() != nil {
+		log.Warn().Msgf("Worker %d: Unable connect to %s (%s): %v", w.id, backend.addr, w.target, err)
+		backend.setUp(false)
+		avoid = backend
+		connectRetryBackoffSeconds.WithLabelValues(w.target).Observe(delay.Seconds())
+		select {
+		case <-ctx.Done():
 			return err
+		case <-time.After(delay):
 		}
-		time.Sleep(delay)
 		delay *= 2
 		if delay > 30*time.Second {
 			delay = 30 * time.Second
 		}
-		//After a failure, move onto a random target
-		targetIdx = rand.Intn(len(w.targets))
 	}
 }
 
@@ -119,10 +178,10 @@ func (w *Worker) ConnectIfNeeded(ctx context.Context) error {
 		return w.ConnectWithRetries(ctx)
 	}
 
-	// Reconnect if it's been 5 minutes
-	// If not connected to the desired target, it will retry the desired target first
-	if time.Since(w.lastReconnect) > 5*time.Minute {
-		log.Debug().Msgf("Worker %d: attempting to reconnect to primary target", w.id)
+	// Health checks, not a fixed timer, now drive reconnects: once the
+	// backend we're on is flagged unhealthy, rebalance onto a healthy one.
+	if !w.backend.IsUp() {
+		log.Debug().Msgf("Worker %d: %s went unhealthy, rebalancing", w.id, w.backend.addr)
 		return w.Reconnect(ctx)
 	}
 	return nil
@@ -131,6 +190,10 @@ func (w *Worker) Close() {
 	if w.conn != nil {
 		w.conn.Close()
 		w.conn = nil
+		w.backend.decActive()
+		w.backend = nil
+		targetConnected.WithLabelValues(w.target, w.String()).Set(0)
+		w.ready.setConnected(w.target, false)
 	}
 }
 
@@ -143,54 +206,93 @@ func (w *Worker) Write(b []byte) (int, error) {
 	n, err := w.conn.Write(b)
 	return n, err
 }
+
+// connectPollInterval bounds a single connect attempt inside
+// WriteWithRetries. ConnectWithRetries itself retries forever (capped
+// backoff) until it connects or ctx is done, so without this bound
+// WriteWithRetries would sit inside it for the whole outage and never get
+// control back to check spoolAfter below.
+const connectPollInterval = 2 * time.Second
+
+// trySpool hands b off to this worker's target spool once deadline has
+// passed, returning true if it was accepted (the caller's write is done).
+func (w *Worker) trySpool(b []byte, deadline time.Time) bool {
+	sp := w.spools[w.target]
+	if sp == nil || !time.Now().After(deadline) {
+		return false
+	}
+	if err := sp.Write(b); err != nil {
+		log.Error().Msgf("Worker %d: failed to spool record for %s: %v", w.id, w.target, err)
+		return false
+	}
+	log.Warn().Msgf("Worker %d: %s unreachable for over %s, spooled record to disk", w.id, w.target, spoolAfter)
+	return true
+}
+
 func (w *Worker) WriteWithRetries(ctx context.Context, b []byte) (int, error) {
+	deadline := time.Now().Add(spoolAfter)
 	for {
-		w.ConnectIfNeeded(ctx)
+		connectCtx, cancel := context.WithTimeout(ctx, connectPollInterval)
+		connErr := w.ConnectIfNeeded(connectCtx)
+		cancel()
+		if connErr != nil {
+			if ctx.Err() != nil {
+				return 0, connErr
+			}
+			if w.trySpool(b, deadline) {
+				return len(b), nil
+			}
+			continue
+		}
+
 		n, err := w.Write(b)
 		if err == nil {
+			recordsOutTotal.WithLabelValues(w.target).Inc()
+			bytesOutTotal.WithLabelValues(w.target).Add(float64(n))
 			return n, err
 		}
 		log.Error().Msgf("Worker %d: Error writing to %s: %v. n=%d, len=%d", w.id, w.target, err, n, len(b))
+		writeRetriesTotal.WithLabelValues(w.target).Inc()
 		w.Close()
+
+		if w.trySpool(b, deadline) {
+			return len(b), nil
+		}
 	}
 }
 
-func transmit(ctx context.Context, worker int, outputChan chan *bytes.Buffer, targets []string, target int) {
-	var b *bytes.Buffer
-
+// transmit writes everything it receives on outputChan to its target,
+// forever, until outputChan is closed AND fully drained -- at which point it
+// exits deterministically. Shutdown is driven entirely by proxy() closing
+// outputChan only once every inbound connection has stopped producing.
+func transmit(ctx context.Context, worker int, outputChan chan *bytes.Buffer, group *TargetGroup, ready *readiness, spools map[string]*Spool) {
 	w := &Worker{
-		id:        worker,
-		targets:   targets,
-		targetIdx: target,
+		id:     worker,
+		group:  group,
+		target: group.Name,
+		dialer: group.dialer,
+		ready:  ready,
+		spools: spools,
 	}
 	err := w.ConnectWithRetries(ctx)
 	//Only happens if we are exiting during startup
 	if err != nil {
 		return
 	}
-	var exit bool
-
-	doneChan := ctx.Done()
 
-	idleCount := 0
 	timer := time.NewTicker(1 * time.Second)
 	defer timer.Stop()
 
 	for {
 		select {
 		case <-timer.C:
-			idleCount++
-			//Exit if we are done and have not received any logs to write in 5 ticks.
-			if exit && idleCount >= 5 {
+			outputChanDepth.WithLabelValues(w.String()).Set(float64(len(outputChan)))
+		case b, ok := <-outputChan:
+			if !ok {
+				log.Info().Msgf("Worker %d: output channel closed and drained, exiting", worker)
 				w.Close()
 				return
 			}
-		case <-doneChan:
-			log.Info().Msgf("Worker %d: draining records and exiting...", worker)
-			exit = true
-			doneChan = nil
-		case b = <-outputChan:
-			idleCount = 0
 			//This will retry forever and will not fail
 			w.WriteWithRetries(context.TODO(), b.Bytes())
 			//Message succesfully sent.. but...
@@ -202,46 +304,136 @@ func transmit(ctx context.Context, worker int, outputChan chan *bytes.Buffer, ta
 		}
 	}
 }
-func proxy(ctx context.Context, l net.Listener, targets []string, connections int) error {
-	outputChan := make(chan *bytes.Buffer, connections*len(targets)*2)
+
+// workerChanDepth is the per-worker output channel depth. Each worker now
+// owns a dedicated channel (rather than all workers sharing one) so that
+// shard-key routing can pick a worker directly.
+const workerChanDepth = 64
+
+func proxy(ctx context.Context, l net.Listener, groups []*TargetGroup, connections int, framing, shardField string, maxRecordBytes int, ready *readiness, spoolDir string, spoolMaxBytes int64, spoolMaxAge time.Duration, dnsInterval, healthInterval time.Duration, healthProbe string, drainTimeout, startupDrainTimeout time.Duration) error {
+	numWorkers := connections * len(groups)
+	outChans := make([]chan *bytes.Buffer, numWorkers)
+	for i := range outChans {
+		outChans[i] = make(chan *bytes.Buffer, workerChanDepth)
+	}
+	ring := NewHashRing(numWorkers)
+
+	var spools map[string]*Spool
+	if spoolDir != "" {
+		spools = make(map[string]*Spool, len(groups))
+	}
+	for _, g := range groups {
+		go g.watchDNS(ctx, dnsInterval, healthInterval, healthProbe)
+		if spools == nil {
+			continue
+		}
+		sp, err := NewSpool(spoolDir, g.Name, spoolMaxBytes, spoolMaxAge)
+		if err != nil {
+			return fmt.Errorf("opening spool for %s: %w", g.Name, err)
+		}
+		spools[g.Name] = sp
+	}
+
+	// Drain whatever each spool already holds before Accept-ing any inbound
+	// connections, so a freshly-written record does not reach a target
+	// ahead of an older one still sitting in that target's spool. Each
+	// target drains concurrently and is bounded by startupDrainTimeout, so a
+	// single target that's been down since before the restart can't hold up
+	// every other (possibly healthy) target's traffic indefinitely; whatever
+	// it didn't finish keeps draining in the background via replaySpool below.
+	// For such a target that ordering is not kept: live workers may deliver
+	// new records to it while older spooled ones are still being replayed.
+	var startupWG sync.WaitGroup
+	for _, g := range groups {
+		sp := spools[g.Name]
+		if sp == nil {
+			continue
+		}
+		startupWG.Add(1)
+		go func(g *TargetGroup, sp *Spool) {
+			defer startupWG.Done()
+			drainCtx, cancel := context.WithTimeout(ctx, startupDrainTimeout)
+			defer cancel()
+			if err := replayOnce(drainCtx, sp, g, g.dialer, ready); err != nil && ctx.Err() == nil {
+				log.Warn().Msgf("Initial spool replay for %s: did not finish within %s, continuing in background: %v", g.Name, startupDrainTimeout, err)
+			}
+		}(g, sp)
+	}
+	startupWG.Wait()
+	for _, g := range groups {
+		if sp := spools[g.Name]; sp != nil {
+			go replaySpool(ctx, sp, g, g.dialer, ready)
+		}
+	}
+
 	var wg sync.WaitGroup
-	for i := 0; i < connections*len(targets); i++ {
+	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
 		go func(idx int) {
-			targetIdx := idx % len(targets)
-			transmit(ctx, idx+1, outputChan, targets, targetIdx)
+			group := groups[idx%len(groups)]
+			transmit(ctx, idx+1, outChans[idx], group, ready, spools)
 			log.Info().Msgf("Worker %d done", idx+1)
 			wg.Done()
 		}(i)
 	}
+
+	// Two-phase shutdown: ctx.Done() only stops Accept-ing new connections.
+	// Existing inbound conns are left open to finish flushing and are only
+	// force-closed if they're still around after drainTimeout.
+	forceClose := make(chan struct{})
 	go func() {
 		<-ctx.Done()
 		l.Close()
+		timer := time.NewTimer(drainTimeout)
+		defer timer.Stop()
+		<-timer.C
+		close(forceClose)
 	}()
-	var err error
+
+	var receiveWG sync.WaitGroup
 	for {
 		conn, err := l.Accept()
 		if err != nil {
 			break
 		}
 		go func() {
-			<-ctx.Done()
+			<-forceClose
 			conn.Close()
 		}()
-		go receive(conn, outputChan)
+		receiveWG.Add(1)
+		go func() {
+			defer receiveWG.Done()
+			receive(conn, outChans, framing, shardField, ring, maxRecordBytes)
+		}()
+	}
+
+	// Every inbound connection has either finished on its own or been
+	// force-closed at the drain deadline -- now it's safe to close each
+	// worker's output channel so transmit() drains it deterministically.
+	log.Info().Msg("No longer accepting connections, draining in-flight records...")
+	receiveWG.Wait()
+	for _, ch := range outChans {
+		close(ch)
 	}
+
 	//Wait for all workers to exit
 	wg.Wait()
-	return err
+	return nil
 }
 
-func listenAndProxy(addr string, port int, targets []string, connections int) error {
+func listenAndProxy(addr string, port int, groups []*TargetGroup, connections int, listenerTLS *tls.Config, framing, shardField string, maxRecordBytes int, ready *readiness, spoolDir string, spoolMaxBytes int64, spoolMaxAge, dnsInterval, healthInterval, drainTimeout, startupDrainTimeout time.Duration, healthProbe string) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	bind := fmt.Sprintf("%s:%d", addr, port)
 	log.Info().Msgf("Listening on %s", bind)
 
-	l, err := net.Listen("tcp", bind)
+	var l net.Listener
+	var err error
+	if listenerTLS != nil {
+		l, err = tls.Listen("tcp", bind, listenerTLS)
+	} else {
+		l, err = net.Listen("tcp", bind)
+	}
 	if err != nil {
 		return err
 	}
@@ -249,11 +441,22 @@ func listenAndProxy(addr string, port int, targets []string, connections int) er
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigs
-		log.Info().Msgf("Received signal %s, exiting", sig)
+		log.Info().Msgf("Received signal %s, draining (up to %s) then exiting", sig, drainTimeout)
 		cancel()
 	}()
 
-	return proxy(ctx, l, targets, connections)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			log.Info().Msg("Received SIGHUP, re-resolving targets without dropping connections")
+			for _, g := range groups {
+				go g.resolve(ctx, healthInterval, healthProbe)
+			}
+		}
+	}()
+
+	return proxy(ctx, l, groups, connections, framing, shardField, maxRecordBytes, ready, spoolDir, spoolMaxBytes, spoolMaxAge, dnsInterval, healthInterval, healthProbe, drainTimeout, startupDrainTimeout)
 }
 
 func main() {
@@ -262,13 +465,65 @@ func main() {
 	var target string
 	var connections int
 	var debug bool
+	var tlsCert, tlsKey, tlsClientCA string
+	var upstreamTLS bool
+	var upstreamCA, upstreamCert, upstreamKey, upstreamSNI string
+	var shardKeyField, framing string
+	var maxRecordBytes int
+	var metricsAddr string
+	var spoolDir string
+	var spoolMaxBytes int64
+	var spoolMaxAge time.Duration
+	var balancerName string
+	var healthInterval, dnsInterval time.Duration
+	var healthProbe string
+	var drainTimeout, startupDrainTimeout time.Duration
 	flag.StringVar(&addr, "addr", "0.0.0.0", "Address to listen on")
 	flag.IntVar(&port, "port", 9000, "Port to listen on")
-	flag.StringVar(&target, "target", "127.0.0.1:9999", "Address to proxy to. separate multiple with comma")
+	flag.StringVar(&target, "target", "127.0.0.1:9999", "Address to proxy to. separate multiple with comma. A DNS name is re-resolved periodically; append @weight (e.g. host:port@3) for the weighted balancer")
 	flag.IntVar(&connections, "connections", 4, "Number of outbound connections to make to each target")
 	flag.BoolVar(&debug, "debug", false, "Enable debug logging")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate file to terminate inbound TLS with (enables TLS listener)")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key file matching -tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA file to verify inbound client certs against (enables mutual TLS)")
+	flag.BoolVar(&upstreamTLS, "upstream-tls", false, "Dial targets over TLS")
+	flag.StringVar(&upstreamCA, "upstream-ca", "", "CA file to verify upstream server certs against (defaults to system roots)")
+	flag.StringVar(&upstreamCert, "upstream-cert", "", "Client certificate file to present to upstreams (mutual TLS)")
+	flag.StringVar(&upstreamKey, "upstream-key", "", "Private key file matching -upstream-cert")
+	flag.StringVar(&upstreamSNI, "upstream-sni", "", "SNI/ServerName to present when dialing upstreams over TLS (defaults to the target host)")
+	flag.StringVar(&shardKeyField, "shard-key", "", "Top-level JSON field to consistent-hash records on, e.g. tenant_id (default: round-robin, no sharding)")
+	flag.StringVar(&framing, "framing", "newline", "How records are framed on the wire: newline, length-prefixed, or json-stream")
+	flag.IntVar(&maxRecordBytes, "max-record-bytes", 16*1024*1024, "Largest record a length-prefixed client may declare; connections claiming more are closed")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":9090", "Address for the /metrics, /healthz and /readyz HTTP server")
+	flag.StringVar(&spoolDir, "spool-dir", "", "Directory to write a per-target on-disk spool to when a target is unreachable (default: disabled, blocks instead)")
+	flag.Int64Var(&spoolMaxBytes, "spool-max-bytes", 1024*1024*1024, "Maximum on-disk bytes to retain per target's spool; oldest records are dropped past this")
+	flag.DurationVar(&spoolMaxAge, "spool-max-age", 24*time.Hour, "Maximum age of a spooled record before it is dropped unreplayed")
+	flag.StringVar(&balancerName, "balancer", "round-robin", "Backend selection policy within a target: round-robin, least-connections, weighted, or ewma")
+	flag.DurationVar(&healthInterval, "health-interval", 5*time.Second, "How often to active-health-check each backend")
+	flag.StringVar(&healthProbe, "health-probe", "", "Optional payload to write after connecting during a health check (default: bare TCP connect)")
+	flag.DurationVar(&dnsInterval, "dns-interval", 30*time.Second, "How often to re-resolve DNS-based targets")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "On shutdown, how long to let existing inbound connections keep flushing before force-closing them")
+	flag.DurationVar(&startupDrainTimeout, "startup-drain-timeout", 30*time.Second, "On startup, how long to wait per target for its on-disk spool backlog to drain before accepting connections; a target still draining past this keeps going in the background")
 	flag.Parse()
 
+	var listenerTLS *tls.Config
+	if tlsCert != "" || tlsKey != "" {
+		var err error
+		listenerTLS, err = tlsListenerConfig(tlsCert, tlsKey, tlsClientCA)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to configure inbound TLS")
+		}
+	}
+
+	var upstreamTLSCfg *tls.Config
+	if upstreamTLS {
+		var err error
+		upstreamTLSCfg, err = tlsDialerConfig(upstreamCA, upstreamCert, upstreamKey, upstreamSNI)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to configure upstream TLS")
+		}
+	}
+
 	// Default level for this example is info, unless debug flag is present
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	if debug {
@@ -279,13 +534,25 @@ func main() {
 		}()
 	}
 
-	targets := strings.Split(target, ",")
+	groups := make([]*TargetGroup, 0, len(strings.Split(target, ",")))
+	groupNames := make([]string, 0, cap(groups))
+	for _, spec := range strings.Split(target, ",") {
+		g, err := newTargetGroup(spec, balancerName)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid -target")
+		}
+		g.dialer = newUpstreamDialer(upstreamTLSCfg, g.host)
+		groups = append(groups, g)
+		groupNames = append(groupNames, g.Name)
+	}
+	ready := newReadiness(groupNames)
+	go serveMetrics(metricsAddr, ready)
 
 	log.Info().Msgf("Listening on %s:%d", addr, port)
 	log.Info().Msgf("Making %d connections to %s", connections, target)
 	log.Info().Msgf("Buffer size %dKiB", bufferSize/1024)
 
-	err := listenAndProxy(addr, port, targets, connections)
+	err := listenAndProxy(addr, port, groups, connections, listenerTLS, framing, shardKeyField, maxRecordBytes, ready, spoolDir, spoolMaxBytes, spoolMaxAge, dnsInterval, healthInterval, drainTimeout, startupDrainTimeout, healthProbe)
 	if err != nil {
 		log.Fatal().AnErr("Encountered errors", err)
 	}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// failingDialer never succeeds, simulating a target that's been down since
+// before a restart.
+type failingDialer struct{}
+
+func (failingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, errors.New("dial refused")
+}
+
+// TestWriteWithRetriesSpoolsDuringAnOutage guards against a regression
+// where WriteWithRetries delegated the whole outage to ConnectWithRetries'
+// open-ended retry loop and never got control back to check spoolAfter, so
+// a genuinely unreachable target (as opposed to one that dials fine but
+// fails writes) never spooled at all.
+func TestWriteWithRetriesSpoolsDuringAnOutage(t *testing.T) {
+	target := "down.example.com:9000"
+	g, err := newTargetGroup(target, "round-robin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.dialer = failingDialer{}
+	g.backends[target] = newBackend(target, 1)
+
+	sp, err := NewSpool(t.TempDir(), target, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Worker{
+		group:  g,
+		target: target,
+		dialer: g.dialer,
+		ready:  newReadiness([]string{target}),
+		spools: map[string]*Spool{target: sp},
+	}
+
+	start := time.Now()
+	n, err := w.WriteWithRetries(context.Background(), []byte("record"))
+	if err != nil {
+		t.Fatalf("WriteWithRetries: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < spoolAfter {
+		t.Fatalf("WriteWithRetries returned after %s, before spoolAfter (%s) elapsed", elapsed, spoolAfter)
+	}
+	if n != len("record") {
+		t.Fatalf("n = %d, want %d", n, len("record"))
+	}
+
+	rotate(t, sp)
+	var replayed []string
+	if err := sp.Replay(context.Background(), func(record []byte) error {
+		replayed = append(replayed, string(record))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 1 || replayed[0] != "record" {
+		t.Fatalf("replayed records = %v, want [%q]", replayed, "record")
+	}
+}
+
+// TestProxyStartupDrainIsBounded guards against a regression where a single
+// stuck target's spool backlog (from before a restart) blocked proxy() from
+// ever Accept-ing connections for any target, including healthy ones.
+func TestProxyStartupDrainIsBounded(t *testing.T) {
+	g, err := newTargetGroup("down.example.com:9000", "round-robin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.dialer = failingDialer{}
+	g.backends["down.example.com:9000"] = newBackend("down.example.com:9000", 1)
+
+	spoolDir := t.TempDir()
+	sp, err := NewSpool(spoolDir, g.Name, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Write([]byte("stale record")); err != nil {
+		t.Fatal(err)
+	}
+	rotate(t, sp)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ready := newReadiness([]string{g.Name})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy(ctx, l, []*TargetGroup{g}, 1, "newline", "", 0, ready, spoolDir, 0, 0, time.Hour, time.Hour, "", time.Second, 50*time.Millisecond)
+	}()
+
+	// proxy() must start Accept-ing well before the spool backlog (which
+	// never drains, since the dialer always fails) would otherwise finish.
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("proxy did not start accepting within the startup drain timeout: %v", err)
+	}
+	conn.Close()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy() did not return after ctx cancellation")
+	}
+}
+
+// TestProxyDrainSequencing checks the two-phase shutdown: cancelling ctx
+// stops Accept immediately, but a connection already in flight is left
+// alone until drainTimeout, at which point it's force-closed.
+func TestProxyDrainSequencing(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, c)
+		}
+	}()
+
+	g, err := newTargetGroup(backend.Addr().String(), "round-robin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.dialer = &net.Dialer{}
+	g.backends[backend.Addr().String()] = newBackend(backend.Addr().String(), 1)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := newReadiness([]string{g.Name})
+	ctx, cancel := context.WithCancel(context.Background())
+	const drainTimeout = 200 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy(ctx, l, []*TargetGroup{g}, 1, "newline", "", 0, ready, "", 0, 0, time.Hour, time.Hour, "", drainTimeout, time.Second)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("one\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	// Accept must stop promptly: a fresh dial should now be refused.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := net.DialTimeout("tcp", l.Addr().String(), 50*time.Millisecond); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("proxy kept accepting new connections after ctx was cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The already-open connection must survive past cancel, well before
+	// drainTimeout elapses.
+	time.Sleep(drainTimeout / 2)
+	if _, err := conn.Write([]byte("two\n")); err != nil {
+		t.Fatalf("existing connection was closed before drainTimeout elapsed: %v", err)
+	}
+
+	// Once drainTimeout elapses, the still-open connection is force-closed.
+	conn.SetReadDeadline(time.Now().Add(2 * drainTimeout))
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatal("expected the connection to be force-closed after drainTimeout")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy() did not return after the drain completed")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	recordsInTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jsontcplb_records_in_total",
+		Help: "Total records accepted from inbound connections.",
+	})
+	bytesInTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jsontcplb_bytes_in_total",
+		Help: "Total bytes accepted from inbound connections.",
+	})
+	recordsOutTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jsontcplb_records_out_total",
+		Help: "Total records written to upstream targets.",
+	}, []string{"target"})
+	bytesOutTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jsontcplb_bytes_out_total",
+		Help: "Total bytes written to upstream targets.",
+	}, []string{"target"})
+	targetConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jsontcplb_target_connected",
+		Help: "1 if a worker is currently connected to its target, 0 otherwise.",
+	}, []string{"target", "worker"})
+	connectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jsontcplb_connects_total",
+		Help: "Total successful connects (including reconnects) to a target.",
+	}, []string{"target"})
+	connectRetryBackoffSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jsontcplb_connect_retry_backoff_seconds",
+		Help:    "Backoff delay slept between failed connect attempts.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 8),
+	}, []string{"target"})
+	writeRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jsontcplb_write_retries_total",
+		Help: "Total write failures that triggered a reconnect-and-retry.",
+	}, []string{"target"})
+	outputChanDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jsontcplb_output_channel_depth",
+		Help: "Current number of buffered records queued for a worker.",
+	}, []string{"worker"})
+)
+
+// readiness tracks, per target, how many workers are connected. Ready once
+// every target has at least one.
+type readiness struct {
+	mu      sync.Mutex
+	workers map[string]int
+}
+
+func newReadiness(targets []string) *readiness {
+	r := &readiness{workers: make(map[string]int, len(targets))}
+	for _, t := range targets {
+		r.workers[t] = 0
+	}
+	return r
+}
+
+func (r *readiness) setConnected(target string, connected bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if connected {
+		r.workers[target]++
+	} else if r.workers[target] > 0 {
+		r.workers[target]--
+	}
+}
+
+func (r *readiness) ready() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, connected := range r.workers {
+		if connected == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// serveMetrics runs the /metrics, /healthz and /readyz HTTP server.
+func serveMetrics(addr string, ready *readiness) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if ready.ready() {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	log.Info().Msgf("Metrics listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error().Msgf("Metrics server exited: %v", err)
+	}
+}
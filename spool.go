@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// spoolSegmentBytes is the size a segment file is allowed to grow to before
+// a new one is rotated in.
+const spoolSegmentBytes = 64 * 1024 * 1024
+
+// spoolAfter is how long a worker keeps retrying a write before it gives up
+// and spools the record to disk instead of blocking the transmit loop.
+const spoolAfter = 10 * time.Second
+
+// Spool is an append-only, segmented write-ahead log for one target's
+// pending records.
+type Spool struct {
+	dir      string
+	target   string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu           sync.Mutex
+	writeSeg     *os.File
+	writeSegIdx  int
+	writeSegSize int64
+}
+
+func targetDirName(target string) string {
+	return strings.NewReplacer(":", "_", "/", "_").Replace(target)
+}
+
+// NewSpool opens (creating if necessary) the on-disk directory for target's
+// spool under baseDir. maxBytes <= 0 means unbounded; maxAge <= 0 means
+// spooled records never expire.
+func NewSpool(baseDir, target string, maxBytes int64, maxAge time.Duration) (*Spool, error) {
+	dir := filepath.Join(baseDir, targetDirName(target))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir, target: target, maxBytes: maxBytes, maxAge: maxAge}, nil
+}
+
+func (s *Spool) segmentPath(idx int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d.seg", idx))
+}
+
+func (s *Spool) checkpointPath() string {
+	return filepath.Join(s.dir, "checkpoint")
+}
+
+// Write appends a record to the current segment, rotating to a new one once
+// spoolSegmentBytes is reached, then evicts the oldest segments if the spool
+// has grown past maxBytes.
+func (s *Spool) Write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writeSeg == nil || s.writeSegSize >= spoolSegmentBytes {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(record)))
+	n1, err := s.writeSeg.Write(lenBuf[:])
+	if err != nil {
+		return err
+	}
+	n2, err := s.writeSeg.Write(record)
+	if err != nil {
+		return err
+	}
+	s.writeSegSize += int64(n1 + n2)
+
+	s.enforceMaxBytesLocked()
+	return nil
+}
+
+func (s *Spool) rotateLocked() error {
+	if s.writeSeg != nil {
+		s.writeSeg.Close()
+	}
+	segments, err := s.listSegments()
+	if err != nil {
+		return err
+	}
+	// Never reuse an index at or below the checkpoint, even once Replay has
+	// unlinked every segment: Replay would skip it.
+	idx := s.loadCheckpoint() + 1
+	if len(segments) > 0 && segments[len(segments)-1] >= idx {
+		idx = segments[len(segments)-1] + 1
+	}
+	f, err := os.OpenFile(s.segmentPath(idx), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.writeSeg = f
+	s.writeSegIdx = idx
+	s.writeSegSize = 0
+	return nil
+}
+
+// enforceMaxBytesLocked drops the oldest un-replayed segments, and bumps the
+// checkpoint past them, until the spool is back under maxBytes. The segment
+// currently being written to is never evicted. Caller must hold s.mu.
+func (s *Spool) enforceMaxBytesLocked() {
+	if s.maxBytes <= 0 {
+		return
+	}
+	segments, err := s.listSegments()
+	if err != nil {
+		return
+	}
+	var total int64
+	sizes := make(map[int]int64, len(segments))
+	for _, idx := range segments {
+		if fi, err := os.Stat(s.segmentPath(idx)); err == nil {
+			sizes[idx] = fi.Size()
+			total += fi.Size()
+		}
+	}
+	for total > s.maxBytes && len(segments) > 1 {
+		oldest := segments[0]
+		if oldest == s.writeSegIdx {
+			break
+		}
+		log.Warn().Msgf("Spool for %s: dropping oldest segment %d to stay under -spool-max-bytes", s.target, oldest)
+		os.Remove(s.segmentPath(oldest))
+		s.saveCheckpoint(oldest)
+		total -= sizes[oldest]
+		segments = segments[1:]
+	}
+}
+
+func (s *Spool) listSegments() ([]int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var idxs []int
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".seg") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".seg"))
+		if err != nil {
+			continue
+		}
+		idxs = append(idxs, n)
+	}
+	sort.Ints(idxs)
+	return idxs, nil
+}
+
+// loadCheckpoint returns the index of the last segment that was fully
+// replayed (and can therefore be skipped), or 0 if there is none yet.
+func (s *Spool) loadCheckpoint() int {
+	b, err := os.ReadFile(s.checkpointPath())
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func (s *Spool) saveCheckpoint(idx int) error {
+	tmp := s.checkpointPath() + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(idx)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.checkpointPath())
+}
+
+// Replay sends every record in every unacknowledged segment, in order, to
+// send. A segment is unlinked (and the checkpoint advanced past it) once all
+// of its records have been sent, or once it's older than maxAge, whichever
+// comes first. The segment currently being written to is left alone.
+func (s *Spool) Replay(ctx context.Context, send func([]byte) error) error {
+	last := s.loadCheckpoint()
+	segments, err := s.listSegments()
+	if err != nil {
+		return err
+	}
+	for _, idx := range segments {
+		if idx <= last {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		s.mu.Lock()
+		openSeg := idx == s.writeSegIdx
+		s.mu.Unlock()
+		if openSeg {
+			break
+		}
+
+		if s.expiredLocked(idx) {
+			log.Warn().Msgf("Spool for %s: dropping segment %d, older than -spool-max-age", s.target, idx)
+		} else if err := s.replaySegment(idx, send); err != nil {
+			return err
+		}
+		if err := s.saveCheckpoint(idx); err != nil {
+			return err
+		}
+		os.Remove(s.segmentPath(idx))
+	}
+	return nil
+}
+
+func (s *Spool) expiredLocked(idx int) bool {
+	if s.maxAge <= 0 {
+		return false
+	}
+	fi, err := os.Stat(s.segmentPath(idx))
+	if err != nil {
+		return false
+	}
+	return time.Since(fi.ModTime()) > s.maxAge
+}
+
+func (s *Spool) replaySegment(idx int, send func([]byte) error) error {
+	f, err := os.Open(s.segmentPath(idx))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		record := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil // Truncated final record from a crash mid-write (possibly right after the length prefix).
+			}
+			return err
+		}
+		if err := send(record); err != nil {
+			return err
+		}
+	}
+}
+
+// replayOnce drains sp's current backlog once, in order, retrying records
+// against group through a dedicated Worker until they succeed (so ordering
+// is preserved even while the target is still down).
+func replayOnce(ctx context.Context, sp *Spool, group *TargetGroup, dialer Dialer, ready *readiness) error {
+	// Close out the segment live workers are appending to, so records they
+	// spooled since the last pass become eligible for Replay.
+	sp.mu.Lock()
+	if sp.writeSeg != nil && sp.writeSegSize > 0 {
+		if err := sp.rotateLocked(); err != nil {
+			sp.mu.Unlock()
+			return err
+		}
+	}
+	sp.mu.Unlock()
+	w := &Worker{
+		group:  group,
+		target: group.Name,
+		dialer: dialer,
+		ready:  ready,
+	}
+	defer w.Close()
+	return sp.Replay(ctx, func(record []byte) error {
+		_, err := w.WriteWithRetries(ctx, record)
+		return err
+	})
+}
+
+// replaySpool calls replayOnce in a loop for as long as ctx is alive,
+// checking back periodically for records newly spooled by the live workers.
+// Callers that need the backlog drained before taking new traffic should
+// call replayOnce directly first.
+func replaySpool(ctx context.Context, sp *Spool, group *TargetGroup, dialer Dialer, ready *readiness) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := replayOnce(ctx, sp, group, dialer, ready); err != nil && ctx.Err() == nil {
+			log.Error().Msgf("Spool replay for %s: %v", group.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
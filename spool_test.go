@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+)
+
+// rotate forces the spool to close its current write segment and open a new
+// one, so previously-written records become eligible for Replay (which never
+// touches the segment currently being written to).
+func rotate(t *testing.T, sp *Spool) {
+	t.Helper()
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if err := sp.rotateLocked(); err != nil {
+		t.Fatalf("rotateLocked: %v", err)
+	}
+}
+
+func TestSpoolReplayPreservesOrderAndCheckpoints(t *testing.T) {
+	sp, err := NewSpool(t.TempDir(), "logs.example.com:9000", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []string{"one", "two", "three"}
+	for _, r := range records {
+		if err := sp.Write([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate(t, sp) // the write segment above is never replayed until rotated out
+
+	var got []string
+	err = sp.Replay(context.Background(), func(record []byte) error {
+		got = append(got, string(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("got %v, want %v", got, records)
+	}
+	for i := range records {
+		if got[i] != records[i] {
+			t.Errorf("record %d = %q, want %q", i, got[i], records[i])
+		}
+	}
+
+	// Replaying again should send nothing new: the checkpoint already
+	// covers the segment we just drained.
+	var again []string
+	if err := sp.Replay(context.Background(), func(record []byte) error {
+		again = append(again, string(record))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 0 {
+		t.Fatalf("second Replay sent %v, want none", again)
+	}
+}
+
+// TestSpoolReplayToleratesCrashRightAfterLengthPrefix guards against a
+// regression where a segment truncated with zero record bytes written after
+// its length prefix (a plausible crash point, since the two are separate
+// Write calls) made replaySegment return io.EOF as a hard error instead of
+// treating it like any other truncated trailing record -- which made Replay
+// fail and left the checkpoint stuck before that segment, so no later
+// segment was ever replayed.
+func TestSpoolReplayToleratesCrashRightAfterLengthPrefix(t *testing.T) {
+	sp, err := NewSpool(t.TempDir(), "logs.example.com:9000", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	rotate(t, sp) // "ok" is now in a closed, replayable segment
+
+	sp.mu.Lock()
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], 5) // claims a 5-byte record that was never written
+	if _, err := sp.writeSeg.Write(lenBuf[:]); err != nil {
+		sp.mu.Unlock()
+		t.Fatal(err)
+	}
+	sp.mu.Unlock()
+	rotate(t, sp) // close the segment holding only the truncated prefix
+
+	var got []string
+	err = sp.Replay(context.Background(), func(record []byte) error {
+		got = append(got, string(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if len(got) != 1 || got[0] != "ok" {
+		t.Fatalf("got %v, want [%q]", got, "ok")
+	}
+}
+
+func TestSpoolEnforceMaxBytesDropsOldestSegment(t *testing.T) {
+	sp, err := NewSpool(t.TempDir(), "logs.example.com:9000", 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sp.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+		rotate(t, sp)
+	}
+	segments, err := sp.listSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) >= 4 {
+		t.Fatalf("expected old segments to be evicted past -spool-max-bytes, got %v", segments)
+	}
+	if sp.loadCheckpoint() == 0 {
+		t.Fatal("expected checkpoint to advance past dropped segments")
+	}
+}
+
+func TestSpoolReplayDropsExpiredSegment(t *testing.T) {
+	sp, err := NewSpool(t.TempDir(), "logs.example.com:9000", 0, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Write([]byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+	rotate(t, sp)
+	time.Sleep(5 * time.Millisecond)
+
+	var got []string
+	err = sp.Replay(context.Background(), func(record []byte) error {
+		got = append(got, string(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected the expired segment's record to be dropped, got %v", got)
+	}
+	if sp.loadCheckpoint() == 0 {
+		t.Fatal("expected checkpoint to advance past the dropped expired segment")
+	}
+}
+
+func TestSpoolReplayStopsAtTruncatedRecord(t *testing.T) {
+	sp, err := NewSpool(t.TempDir(), "logs.example.com:9000", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash mid-write: append a length prefix whose payload never
+	// arrives.
+	f, err := os.OpenFile(sp.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 100, 'x'}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	rotate(t, sp)
+
+	var got []string
+	err = sp.Replay(context.Background(), func(record []byte) error {
+		got = append(got, string(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay should tolerate a truncated trailing record, got: %v", err)
+	}
+	if len(got) != 1 || got[0] != "ok" {
+		t.Fatalf("got %v, want [ok]", got)
+	}
+}
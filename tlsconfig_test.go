@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert generates a self-signed cert/key pair and writes each to
+// its own PEM file under t.TempDir(), returning both paths.
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSListenerConfigLoadsCertAndKey(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	cfg, err := tlsListenerConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Certificates) != 1 {
+		t.Fatalf("got %d certificates, want 1", len(cfg.Certificates))
+	}
+	if cfg.ClientAuth != tls.NoClientCert {
+		t.Fatalf("ClientAuth = %v, want NoClientCert when -tls-client-ca is unset", cfg.ClientAuth)
+	}
+}
+
+func TestTLSListenerConfigRequiresClientCertsWithCA(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	cfg, err := tlsListenerConfig(certFile, keyFile, certFile) // self-signed cert doubles as its own CA
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("ClientAuth = %v, want RequireAndVerifyClientCert", cfg.ClientAuth)
+	}
+	if cfg.ClientCAs == nil {
+		t.Fatal("ClientCAs not set")
+	}
+}
+
+func TestTLSListenerConfigRejectsMissingCert(t *testing.T) {
+	if _, err := tlsListenerConfig("/nonexistent/cert.pem", "/nonexistent/key.pem", ""); err == nil {
+		t.Fatal("expected an error for a missing cert/key file")
+	}
+}
+
+func TestTLSDialerConfigDefaults(t *testing.T) {
+	cfg, err := tlsDialerConfig("", "", "", "upstream.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerName != "upstream.example.com" {
+		t.Fatalf("ServerName = %q, want %q", cfg.ServerName, "upstream.example.com")
+	}
+	if cfg.RootCAs != nil || len(cfg.Certificates) != 0 {
+		t.Fatal("expected no CA pool or client cert without -upstream-ca/-upstream-cert")
+	}
+}
+
+func TestTLSDialerConfigLoadsCAAndClientCert(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	cfg, err := tlsDialerConfig(certFile, certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RootCAs == nil {
+		t.Fatal("RootCAs not set")
+	}
+	if len(cfg.Certificates) != 1 {
+		t.Fatalf("got %d certificates, want 1", len(cfg.Certificates))
+	}
+}
+
+func TestLoadCertPoolRejectsGarbagePEM(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(path, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCertPool(path); err == nil {
+		t.Fatal("expected an error for a file with no PEM certificates")
+	}
+}